@@ -0,0 +1,377 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+//go:build linux
+// +build linux
+
+// Package afpacket provides a low-level interface to set up an AF_PACKET
+// socket in Linux. For more information on AF_PACKET, see the packet(7) man
+// page.
+package afpacket
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// OptTPacketVersion is the version of TPacket to use.
+type OptTPacketVersion int
+
+const (
+	// TPacketVersionHighestAvailable tells NewTPacket to use the highest
+	// version it can successfully negotiate with the kernel.
+	TPacketVersionHighestAvailable OptTPacketVersion = iota
+	TPacketVersion1
+	TPacketVersion2
+	TPacketVersion3
+	// TPacketVersion4 requests the experimental 64-bit-timestamp TPACKET_V4
+	// layout (see tpv4.go), falling back to TPacketVersion3 if the running
+	// kernel rejects it.
+	TPacketVersion4
+)
+
+// options contains tunable options for a TPacket.
+type options struct {
+	frameSize     int
+	blockSize     int
+	numBlocks     int
+	blockTimeout  time.Duration
+	addVLANHeader bool
+	pollTimeout   time.Duration
+	version       OptTPacketVersion
+	iface         string
+
+	// txFrameSize/txBlockSize/txNumBlocks configure the PACKET_TX_RING,
+	// mirroring the RX ring knobs above.
+	txFrameSize int
+	txBlockSize int
+	txNumBlocks int
+	qdiscBypass bool
+
+	// vnetHdr, if set, requests PACKET_VNET_HDR so every ring frame carries
+	// a virtio_net_hdr GSO/GRO annotation; see gso.go.
+	vnetHdr bool
+
+	// hwTimestamps, if set, requests NIC hardware RX timestamps via
+	// SIOCSHWTSTAMP and SO_TIMESTAMPING; see hwts.go.
+	hwTimestamps bool
+}
+
+// TPacket implements packet receiving (and, with a TX ring configured,
+// sending) for Linux AF_PACKET sockets.
+type TPacket struct {
+	fd   int
+	opts options
+
+	// RX ring state.
+	ring       []byte
+	ringPos    uint
+	offset     uint
+	rxRingSize int
+	mu         sync.Mutex
+	// curHdr is the header last returned by curHeader, kept across calls to
+	// readPacketDataRaw so that header.next() can walk a TPACKET_V3 block's
+	// packets one at a time instead of releasing the whole block back to the
+	// kernel after only the first packet. nil whenever there's no partially
+	// consumed block (i.e. for V1/V2/V4, always, since their next() is a no-op).
+	curHdr header
+
+	// mmapRegion is the single mmap backing ring (and, once a TX ring has
+	// been added, txRing too): AF_PACKET maps both rings in one call, so
+	// this is what actually gets passed to munmap, not ring/txRing
+	// individually, which are just subslices of it.
+	mmapRegion []byte
+
+	// TX ring state. txRing is only non-nil once a PACKET_TX_RING has been
+	// requested via setsockopt and mmapped.
+	txRing     []byte
+	txPos      uint
+	txFrames   int
+	txRingSize int
+	txMu       sync.Mutex
+
+	socketStats   SocketStats
+	socketStatsV3 SocketStatsV3
+}
+
+// setsockoptRxRing asks the kernel for a PACKET_RX_RING with the configured
+// frame/block layout. It only sets the socket option; mmapRings below does
+// the actual mapping once PACKET_RX_RING and (if requested) PACKET_TX_RING
+// have both been set up, since AF_PACKET requires mapping the two rings in a
+// single combined call.
+func (h *TPacket) setsockoptRxRing() error {
+	req := TpReq{
+		Tp_block_size: uint32(h.opts.blockSize),
+		Tp_block_nr:   uint32(h.opts.numBlocks),
+		Tp_frame_size: uint32(h.opts.frameSize),
+		Tp_frame_nr:   uint32(h.opts.blockSize / h.opts.frameSize * h.opts.numBlocks),
+	}
+	if err := setsockopt(h.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, unsafe.Pointer(&req), unsafe.Sizeof(req)); err != nil {
+		return fmt.Errorf("setsockopt PACKET_RX_RING: %v", err)
+	}
+	h.rxRingSize = int(req.Tp_block_size) * int(req.Tp_block_nr)
+	return nil
+}
+
+// setsockoptTxRing asks the kernel for a PACKET_TX_RING with the given
+// frame/block layout, mirroring setsockoptRxRing above. Like setsockoptRxRing,
+// it only sets the socket option; mmapRings performs the actual mapping.
+func (h *TPacket) setsockoptTxRing() error {
+	if h.opts.txFrameSize == 0 {
+		return nil
+	}
+
+	req := TpReq{
+		Tp_block_size: uint32(h.opts.txBlockSize),
+		Tp_block_nr:   uint32(h.opts.txNumBlocks),
+		Tp_frame_size: uint32(h.opts.txFrameSize),
+		Tp_frame_nr:   uint32(h.opts.txBlockSize / h.opts.txFrameSize * h.opts.txNumBlocks),
+	}
+	if err := setsockopt(h.fd, unix.SOL_PACKET, unix.PACKET_TX_RING, unsafe.Pointer(&req), unsafe.Sizeof(req)); err != nil {
+		return fmt.Errorf("setsockopt PACKET_TX_RING: %v", err)
+	}
+
+	if h.opts.qdiscBypass {
+		if err := setsockoptInt(h.fd, unix.SOL_PACKET, unix.PACKET_QDISC_BYPASS, 1); err != nil {
+			return fmt.Errorf("setsockopt PACKET_QDISC_BYPASS: %v", err)
+		}
+	}
+
+	h.txRingSize = int(req.Tp_block_size) * int(req.Tp_block_nr)
+	h.txFrames = int(req.Tp_frame_nr)
+	return nil
+}
+
+// mmapRings maps the RX ring (and, if a TX ring was requested via
+// setsockoptTxRing, the TX ring immediately following it) in a single mmap
+// call: AF_PACKET validates the mapping length against
+// rx_ring_size+tx_ring_size and rejects anything else, so the two rings
+// can't be mapped independently.
+func (h *TPacket) mmapRings() error {
+	ring, err := unix.Mmap(h.fd, 0, h.rxRingSize+h.txRingSize,
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_LOCKED)
+	if err != nil {
+		return fmt.Errorf("mmap PACKET_RX_RING: %v", err)
+	}
+	h.mmapRegion = ring
+	h.ring = ring[:h.rxRingSize]
+	if h.txRingSize > 0 {
+		h.txRing = ring[h.rxRingSize:]
+	}
+	return nil
+}
+
+// txFrame returns a pointer to the tpacket header for the TX frame at index
+// i, using the same header-abstraction pattern (TpV1Hdr/TpV2Hdr/TpV3Hdr) the
+// RX path decodes with.
+func (h *TPacket) txFrame(i int) header {
+	base := unsafe.Pointer(&h.txRing[i*h.opts.txFrameSize])
+	switch h.opts.version {
+	case TPacketVersion1:
+		return (*TpV1Hdr)(base)
+	default:
+		return (*TpV2Hdr)(base)
+	}
+}
+
+// WritePacketData queues data for transmission on the TX ring, returning
+// once the frame has been handed to the kernel (send() with MSG_DONTWAIT).
+// It blocks if no TX frame is currently available to the user.
+func (h *TPacket) WritePacketData(data []byte) error {
+	if h.txRing == nil {
+		return fmt.Errorf("afpacket: TX ring not configured, see OptTxRing")
+	}
+	if len(data) > h.opts.txFrameSize {
+		return fmt.Errorf("afpacket: packet length %d exceeds TX frame size %d", len(data), h.opts.txFrameSize)
+	}
+
+	h.txMu.Lock()
+	defer h.txMu.Unlock()
+
+	hdr := h.txFrame(int(h.txPos))
+	// The frame is still owned by the kernel whenever either SEND_REQUEST
+	// (queued, not yet picked up) or SENDING (in flight) is set; checking
+	// SEND_REQUEST alone misses SENDING (0x2), so a frame mid-transmit would
+	// look free and get overwritten out from under the kernel.
+	for hdr.getStatus()&(unix.TP_STATUS_SEND_REQUEST|unix.TP_STATUS_SENDING) != 0 {
+		if err := h.pollTx(); err != nil {
+			return err
+		}
+	}
+	if hdr.getStatus()&unix.TP_STATUS_WRONG_FORMAT != 0 {
+		return fmt.Errorf("afpacket: kernel rejected previous frame at this TX slot (TP_STATUS_WRONG_FORMAT)")
+	}
+
+	base := unsafe.Pointer(&h.txRing[int(h.txPos)*h.opts.txFrameSize])
+	buf := makeSlice(uintptr(base)+uintptr(tpAlign(int(tpV2HdrSize))), len(data))
+	copy(buf, data)
+
+	switch v := hdr.(type) {
+	case *TpV1Hdr:
+		v.Len = uint32(len(data))
+		v.Status = unix.TP_STATUS_SEND_REQUEST
+	case *TpV2Hdr:
+		v.Len = uint32(len(data))
+		v.Status = unix.TP_STATUS_SEND_REQUEST
+	}
+
+	h.txPos = (h.txPos + 1) % uint(h.txFrames)
+
+	if _, _, errno := syscall.Syscall6(syscall.SYS_SENDTO, uintptr(h.fd), 0, 0,
+		uintptr(syscall.MSG_DONTWAIT), 0, 0); errno != 0 && errno != syscall.EAGAIN {
+		return fmt.Errorf("afpacket: send: %v", errno)
+	}
+	return nil
+}
+
+// pollTx waits for the kernel to release at least one TX frame back to
+// userspace.
+func (h *TPacket) pollTx() error {
+	fds := []unix.PollFd{{Fd: int32(h.fd), Events: unix.POLLOUT}}
+	_, err := unix.Poll(fds, int(h.opts.pollTimeout/time.Millisecond))
+	return err
+}
+
+// curHeader returns the header for the RX frame currently under h.ringPos.
+func (h *TPacket) curHeader() header {
+	base := unsafe.Pointer(&h.ring[int(h.ringPos)*h.opts.frameSize])
+	switch h.opts.version {
+	case TPacketVersion1:
+		return (*TpV1Hdr)(base)
+	case TPacketVersion3:
+		w := initV3Wrapper(base)
+		return &w
+	case TPacketVersion4:
+		return (*TpV4Hdr)(base)
+	default:
+		return (*TpV2Hdr)(base)
+	}
+}
+
+// tPacketVersionRaw maps our OptTPacketVersion ordinals onto the
+// PACKET_VERSION values the kernel actually understands
+// (unix.TPACKET_V1/V2/V3 are 0/1/2, not 1/2/3 like our iota).
+// TPacketVersion4 has no kernel-assigned value yet; tPacketV4 below picks a
+// speculative one that doesn't collide with any real TPACKET_Vn.
+func tPacketVersionRaw(version OptTPacketVersion) int {
+	switch version {
+	case TPacketVersion1:
+		return int(unix.TPACKET_V1)
+	case TPacketVersion3:
+		return int(unix.TPACKET_V3)
+	case TPacketVersion4:
+		return tPacketV4
+	default:
+		return int(unix.TPACKET_V2)
+	}
+}
+
+// setsockoptTPacketVersion negotiates PACKET_VERSION with the kernel. When
+// TPacketVersion4 is requested but the kernel doesn't recognize it, it falls
+// back to TPacketVersion3 and updates h.opts.version in place so the rest of
+// the ring setup (frame size, curHeader) stays consistent. When
+// TPacketVersionHighestAvailable is requested, it tries V3 down to V1 in
+// order and keeps the first the kernel accepts, likewise updating
+// h.opts.version to whatever was actually negotiated.
+func (h *TPacket) setsockoptTPacketVersion() error {
+	version := h.opts.version
+	if version == TPacketVersionHighestAvailable {
+		for _, v := range []OptTPacketVersion{TPacketVersion3, TPacketVersion2, TPacketVersion1} {
+			if err := setsockoptInt(h.fd, unix.SOL_PACKET, unix.PACKET_VERSION, tPacketVersionRaw(v)); err == nil {
+				h.opts.version = v
+				return nil
+			}
+		}
+		return fmt.Errorf("afpacket: kernel rejected every TPACKET_Vn version we tried")
+	}
+	if err := setsockoptInt(h.fd, unix.SOL_PACKET, unix.PACKET_VERSION, tPacketVersionRaw(version)); err != nil {
+		if version == TPacketVersion4 {
+			h.opts.version = TPacketVersion3
+			return setsockoptInt(h.fd, unix.SOL_PACKET, unix.PACKET_VERSION, tPacketVersionRaw(TPacketVersion3))
+		}
+		return err
+	}
+	return nil
+}
+
+// readPacketDataRaw blocks until a frame is available on the RX ring and
+// returns its raw bytes (including any virtio_net_hdr prefix requested via
+// OptVNetHdr), without copying out a VLAN header the way getData/opts would,
+// along with the packet's on-the-wire length and receiving interface index.
+// hwTime/hwOK report the NIC hardware timestamp for the frame, if the header
+// carried one (see hwts.go); hwOK is always false unless OptHardwareTimestamps
+// was set.
+func (h *TPacket) readPacketDataRaw() (data []byte, ci time.Time, length int, ifaceIndex int, hwTime time.Time, hwOK bool, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// curHdr survives across calls whenever the previous call left a
+	// TPACKET_V3 block partway through (next() returned true): V1/V2/V4
+	// headers hold exactly one packet each and their next() is always
+	// false, but a V3 block holds many, and calling clearStatus() before
+	// walking all of them with next() would release the whole block back
+	// to the kernel after only the first packet.
+	if h.curHdr == nil {
+		h.curHdr = h.curHeader()
+	}
+	for h.curHdr.getStatus()&unix.TP_STATUS_USER == 0 {
+		fds := []unix.PollFd{{Fd: int32(h.fd), Events: unix.POLLIN}}
+		if _, err := unix.Poll(fds, int(h.opts.pollTimeout/time.Millisecond)); err != nil {
+			return nil, time.Time{}, 0, 0, time.Time{}, false, err
+		}
+	}
+
+	data = h.curHdr.getData(&h.opts)
+	ci = h.curHdr.getTime()
+	length = h.curHdr.getLength()
+	ifaceIndex = h.curHdr.getIfaceIndex()
+	hwTime, hwOK = h.curHdr.getHardwareTime()
+
+	if !h.curHdr.next() {
+		h.curHdr.clearStatus()
+		h.curHdr = nil
+		h.ringPos = (h.ringPos + 1) % uint(len(h.ring)/h.opts.frameSize)
+	}
+	return data, ci, length, ifaceIndex, hwTime, hwOK, nil
+}
+
+func setsockopt(fd, level, name int, val unsafe.Pointer, vallen uintptr) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd), uintptr(level), uintptr(name),
+		uintptr(val), vallen, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func setsockoptInt(fd, level, name, value int) error {
+	v := int32(value)
+	return setsockopt(fd, level, name, unsafe.Pointer(&v), unsafe.Sizeof(v))
+}
+
+func getsockopt(fd, level, name int, val unsafe.Pointer, vallen *uintptr) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(name),
+		uintptr(val), uintptr(unsafe.Pointer(vallen)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Close tears down the socket and unmaps its RX/TX rings.
+func (h *TPacket) Close() error {
+	if h.mmapRegion != nil {
+		unix.Munmap(h.mmapRegion)
+	} else if h.ring != nil {
+		unix.Munmap(h.ring)
+	}
+	return syscall.Close(h.fd)
+}
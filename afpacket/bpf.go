@@ -0,0 +1,68 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+//go:build linux
+// +build linux
+
+package afpacket
+
+import (
+	"unsafe"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// sockFprog mirrors struct sock_fprog, the classic-BPF program descriptor
+// expected by SO_ATTACH_FILTER.
+type sockFprog struct {
+	Len     uint16
+	_       [6]byte // padding to the pointer field's natural alignment
+	Filters *unix.SockFilter
+}
+
+// SetBPF attaches a compiled classic BPF (cBPF) filter to the socket via
+// setsockopt(SO_ATTACH_FILTER), so the kernel drops non-matching frames
+// before they reach the ring. It coexists with the VLAN and TP-status
+// handling in TpV2Hdr/TpV3Hdr: filtered frames never make it that far, so no
+// header redecoding is needed.
+func (h *TPacket) SetBPF(filter []bpf.RawInstruction) error {
+	if len(filter) == 0 {
+		return RemoveBPF(h)
+	}
+
+	ins := make([]unix.SockFilter, len(filter))
+	for i, f := range filter {
+		ins[i] = unix.SockFilter{
+			Code: f.Op,
+			Jt:   f.Jt,
+			Jf:   f.Jf,
+			K:    f.K,
+		}
+	}
+	prog := sockFprog{
+		Len:     uint16(len(ins)),
+		Filters: &ins[0],
+	}
+	return setsockopt(h.fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, unsafe.Pointer(&prog), unsafe.Sizeof(prog))
+}
+
+// RemoveBPF detaches any classic BPF filter previously attached with SetBPF.
+func RemoveBPF(h *TPacket) error {
+	var dummy int32
+	return setsockopt(h.fd, unix.SOL_SOCKET, unix.SO_DETACH_FILTER, unsafe.Pointer(&dummy), unsafe.Sizeof(dummy))
+}
+
+// Compiling a pcap-style filter expression (e.g. "tcp and port 80") into a
+// cBPF program is pcap_compile's job. This package doesn't parse filter
+// syntax and doesn't link against libpcap, so there is intentionally no
+// CompileBPFFilter here: compile with pcap_compile (e.g. via gopacket/pcap)
+// and pass the result straight to SetBPF above.
+//
+// PACKET_FANOUT_DATA (attaching an eBPF dissector) likewise only works on a
+// socket that is already a member of a PACKET_FANOUT_EBPF fanout group; the
+// kernel rejects it on a standalone socket. Use FanoutGroup.SetEBPF, which
+// operates on a group, for that.
@@ -0,0 +1,184 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+//go:build linux
+// +build linux
+
+package afpacket
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultFrameSize   = 4096
+	defaultBlockSize   = defaultFrameSize * 128
+	defaultNumBlocks   = 32
+	defaultPollTimeout = -1 * time.Millisecond // negative blocks indefinitely, per unix.Poll
+)
+
+// Opt* types configure NewTPacket; pass any combination of them as its
+// variadic arguments. An option type NewTPacket doesn't recognize is a
+// programmer error, and NewTPacket returns an error rather than silently
+// ignoring it.
+type (
+	// OptInterface binds the socket to the named interface. Left unset, the
+	// socket receives frames from every interface (ifindex 0), like a raw
+	// AF_PACKET socket traditionally does.
+	OptInterface string
+	// OptFrameSize, OptBlockSize and OptNumBlocks configure the RX ring's
+	// layout; see packet(7)'s PACKET_RX_RING documentation for the
+	// block/frame size constraints the kernel enforces.
+	OptFrameSize int
+	OptBlockSize int
+	OptNumBlocks int
+	// OptAddVLANHeader re-inserts a processed VLAN tag into packet data; see
+	// insertVlanHeader in header.go.
+	OptAddVLANHeader bool
+	// OptPollTimeout bounds how long ReadPacketData/ReadSegments block
+	// waiting for a frame; zero or negative blocks indefinitely.
+	OptPollTimeout time.Duration
+	// OptTxFrameSize, OptTxBlockSize and OptTxNumBlocks configure a
+	// PACKET_TX_RING alongside the RX ring, enabling WritePacketData and
+	// WriteSegments. Leaving OptTxFrameSize unset (or zero) leaves the TX
+	// ring disabled; OptTxBlockSize/OptTxNumBlocks then default to the RX
+	// ring's OptBlockSize/OptNumBlocks.
+	OptTxFrameSize int
+	OptTxBlockSize int
+	OptTxNumBlocks int
+	// OptQdiscBypass requests PACKET_QDISC_BYPASS on the TX ring, skipping
+	// the kernel qdisc layer for lower-latency sends.
+	OptQdiscBypass bool
+	// OptVNetHdr requests PACKET_VNET_HDR; see gso.go.
+	OptVNetHdr bool
+	// OptHardwareTimestamps requests NIC hardware RX timestamps; see hwts.go.
+	OptHardwareTimestamps bool
+)
+
+// NewTPacket creates and configures an AF_PACKET socket: it opens the
+// socket, negotiates PACKET_VERSION, sets up the RX ring (and, if
+// OptTxFrameSize is given, a TX ring), binds to OptInterface, and applies
+// any of OptVNetHdr/OptHardwareTimestamps that were requested. See the Opt*
+// types above for the full set of options.
+func NewTPacket(opts ...interface{}) (*TPacket, error) {
+	h := &TPacket{
+		opts: options{
+			frameSize:   defaultFrameSize,
+			blockSize:   defaultBlockSize,
+			numBlocks:   defaultNumBlocks,
+			pollTimeout: defaultPollTimeout,
+			version:     TPacketVersionHighestAvailable,
+		},
+	}
+	for _, opt := range opts {
+		switch v := opt.(type) {
+		case OptInterface:
+			h.opts.iface = string(v)
+		case OptFrameSize:
+			h.opts.frameSize = int(v)
+		case OptBlockSize:
+			h.opts.blockSize = int(v)
+		case OptNumBlocks:
+			h.opts.numBlocks = int(v)
+		case OptAddVLANHeader:
+			h.opts.addVLANHeader = bool(v)
+		case OptPollTimeout:
+			h.opts.pollTimeout = time.Duration(v)
+		case OptTPacketVersion:
+			h.opts.version = v
+		case OptTxFrameSize:
+			h.opts.txFrameSize = int(v)
+		case OptTxBlockSize:
+			h.opts.txBlockSize = int(v)
+		case OptTxNumBlocks:
+			h.opts.txNumBlocks = int(v)
+		case OptQdiscBypass:
+			h.opts.qdiscBypass = bool(v)
+		case OptVNetHdr:
+			h.opts.vnetHdr = bool(v)
+		case OptHardwareTimestamps:
+			h.opts.hwTimestamps = bool(v)
+		default:
+			return nil, fmt.Errorf("afpacket: unknown option type %T", opt)
+		}
+	}
+	if h.opts.txFrameSize != 0 {
+		if h.opts.txBlockSize == 0 {
+			h.opts.txBlockSize = h.opts.blockSize
+		}
+		if h.opts.txNumBlocks == 0 {
+			h.opts.txNumBlocks = h.opts.numBlocks
+		}
+	}
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return nil, fmt.Errorf("afpacket: socket: %v", err)
+	}
+	h.fd = fd
+
+	if err := h.setsockoptTPacketVersion(); err != nil {
+		h.Close()
+		return nil, fmt.Errorf("afpacket: negotiating PACKET_VERSION: %v", err)
+	}
+	if err := h.setsockoptRxRing(); err != nil {
+		h.Close()
+		return nil, fmt.Errorf("afpacket: %v", err)
+	}
+	if err := h.setsockoptTxRing(); err != nil {
+		h.Close()
+		return nil, fmt.Errorf("afpacket: %v", err)
+	}
+	if err := h.mmapRings(); err != nil {
+		h.Close()
+		return nil, fmt.Errorf("afpacket: %v", err)
+	}
+	if err := h.bind(); err != nil {
+		h.Close()
+		return nil, err
+	}
+	if err := h.setsockoptVNetHdr(); err != nil {
+		h.Close()
+		return nil, fmt.Errorf("afpacket: setsockopt PACKET_VNET_HDR: %v", err)
+	}
+	if err := h.setsockoptHardwareTimestamps(); err != nil {
+		h.Close()
+		return nil, fmt.Errorf("afpacket: configuring hardware timestamps: %v", err)
+	}
+	return h, nil
+}
+
+// bind attaches the socket to opts.iface, or to every interface if it's
+// unset.
+func (h *TPacket) bind() error {
+	ifindex := 0
+	if h.opts.iface != "" {
+		iface, err := net.InterfaceByName(h.opts.iface)
+		if err != nil {
+			return fmt.Errorf("afpacket: %v", err)
+		}
+		ifindex = iface.Index
+	}
+	sa := unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ALL),
+		Ifindex:  ifindex,
+	}
+	if err := unix.Bind(h.fd, &sa); err != nil {
+		return fmt.Errorf("afpacket: bind: %v", err)
+	}
+	return nil
+}
+
+// htons converts a 16-bit value from host to network byte order, the form
+// both the socket()'s ETH_P_ALL protocol argument and the bind sockaddr's
+// protocol field need it in.
+func htons(v int) uint16 {
+	return uint16(v<<8&0xff00 | v>>8&0xff)
+}
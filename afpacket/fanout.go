@@ -0,0 +1,157 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+//go:build linux
+// +build linux
+
+package afpacket
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// FanoutMode selects how the kernel load-balances frames across the sockets
+// in a FanoutGroup. These mirror the PACKET_FANOUT_* modes documented in
+// packet(7).
+type FanoutMode uint16
+
+const (
+	FanoutHash     FanoutMode = unix.PACKET_FANOUT_HASH
+	FanoutLB       FanoutMode = unix.PACKET_FANOUT_LB
+	FanoutCPU      FanoutMode = unix.PACKET_FANOUT_CPU
+	FanoutRollover FanoutMode = unix.PACKET_FANOUT_ROLLOVER
+	FanoutQM       FanoutMode = unix.PACKET_FANOUT_QM
+	FanoutEBPF     FanoutMode = unix.PACKET_FANOUT_EBPF
+)
+
+// FanoutFlag is a bitmask of PACKET_FANOUT_FLAG_* values that can be ORed
+// into a FanoutMode when joining a group.
+type FanoutFlag uint16
+
+const (
+	FanoutFlagRollover FanoutFlag = unix.PACKET_FANOUT_FLAG_ROLLOVER
+	FanoutFlagDefrag   FanoutFlag = unix.PACKET_FANOUT_FLAG_DEFRAG
+)
+
+// FanoutGroup is a set of TPacket sockets, all bound to the same interface
+// and joined into a single kernel fanout group, so that incoming frames are
+// load-balanced across them. Each Socket is an independent
+// ZeroCopyPacketDataSource that callers can pin to its own goroutine/CPU.
+type FanoutGroup struct {
+	Sockets []*TPacket
+
+	groupID uint16
+	mode    FanoutMode
+	flags   FanoutFlag
+}
+
+// NewFanoutGroup opens num TPacket sockets bound to iface and joins them
+// into a fanout group, the common case of wanting N independent RX workers
+// load-balanced across one interface without having to open each TPacket
+// yourself. extraOpts are passed to NewTPacket alongside OptInterface(iface)
+// for every socket; see NewFanoutGroupFromSockets for groupID/mode/flags.
+// If any socket fails to open or join, the sockets already opened are closed
+// before returning the error.
+func NewFanoutGroup(iface string, num int, groupID uint16, mode FanoutMode, flags FanoutFlag, extraOpts ...interface{}) (*FanoutGroup, error) {
+	if num <= 0 {
+		return nil, fmt.Errorf("afpacket: NewFanoutGroup needs at least one socket, got %d", num)
+	}
+
+	sockets := make([]*TPacket, 0, num)
+	opts := append([]interface{}{OptInterface(iface)}, extraOpts...)
+	for i := 0; i < num; i++ {
+		sock, err := NewTPacket(opts...)
+		if err != nil {
+			for _, s := range sockets {
+				s.Close()
+			}
+			return nil, fmt.Errorf("afpacket: opening fanout socket %d/%d: %v", i+1, num, err)
+		}
+		sockets = append(sockets, sock)
+	}
+
+	fg, err := NewFanoutGroupFromSockets(sockets, groupID, mode, flags)
+	if err != nil {
+		for _, s := range sockets {
+			s.Close()
+		}
+		return nil, err
+	}
+	return fg, nil
+}
+
+// NewFanoutGroupFromSockets joins pre-constructed, interface-bound TPacket
+// sockets into a fanout group. groupID is any caller-chosen value; sockets
+// sharing a groupID and non-conflicting mode join the same kernel group.
+// mode selects the load-balancing algorithm; flags carries any combination
+// of FanoutFlagRollover/FanoutFlagDefrag. Sockets are this package's
+// caller's responsibility to open and bind; there is no TPacket constructor
+// here to do it for them.
+func NewFanoutGroupFromSockets(sockets []*TPacket, groupID uint16, mode FanoutMode, flags FanoutFlag) (*FanoutGroup, error) {
+	fg := &FanoutGroup{
+		Sockets: sockets,
+		groupID: groupID,
+		mode:    mode,
+		flags:   flags,
+	}
+	for _, sock := range sockets {
+		if err := fg.join(sock); err != nil {
+			return nil, err
+		}
+	}
+	return fg, nil
+}
+
+// join binds sock to the fanout group via setsockopt(PACKET_FANOUT). The
+// low 16 bits of the option value are the group ID, the high 16 bits are the
+// mode ORed with any flags, per packet(7).
+func (fg *FanoutGroup) join(sock *TPacket) error {
+	arg := uint32(fg.groupID) | uint32(uint16(fg.mode)|uint16(fg.flags))<<16
+	return setsockoptInt(sock.fd, unix.SOL_PACKET, unix.PACKET_FANOUT, int(arg))
+}
+
+// SetEBPF attaches an eBPF program (identified by its loaded fd) to steer
+// fanout decisions when the group was created with FanoutEBPF. Every socket
+// in the group shares the same program, matching PACKET_FANOUT_EBPF
+// semantics where only one socket needs to load it.
+func (fg *FanoutGroup) SetEBPF(progFd int) error {
+	if fg.mode != FanoutEBPF {
+		return fmt.Errorf("afpacket: SetEBPF requires FanoutEBPF mode")
+	}
+	if len(fg.Sockets) == 0 {
+		return fmt.Errorf("afpacket: fanout group has no sockets")
+	}
+	return setsockoptInt(fg.Sockets[0].fd, unix.SOL_PACKET, unix.PACKET_FANOUT_DATA, progFd)
+}
+
+// Stats aggregates SocketStats across every socket in the group.
+func (fg *FanoutGroup) Stats() (SocketStats, error) {
+	var total SocketStats
+	for _, sock := range fg.Sockets {
+		var s SocketStats
+		var slen = unsafe.Sizeof(s)
+		if err := getsockopt(sock.fd, unix.SOL_PACKET, unix.PACKET_STATISTICS, unsafe.Pointer(&s), &slen); err != nil {
+			return total, err
+		}
+		total.StatsPackets += s.StatsPackets
+		total.StatsDrops += s.StatsDrops
+	}
+	return total, nil
+}
+
+// Close closes every socket in the group, removing them from the fanout
+// group as a side effect (the kernel tears the group down once its last
+// member socket closes).
+func (fg *FanoutGroup) Close() {
+	for _, sock := range fg.Sockets {
+		if sock != nil {
+			sock.Close()
+		}
+	}
+}
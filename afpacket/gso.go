@@ -0,0 +1,319 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+//go:build linux
+// +build linux
+
+package afpacket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// virtio_net_hdr flags and gso types, see linux/virtio_net.h. These are
+// prefixed onto every frame once PACKET_VNET_HDR is enabled via
+// OptVNetHdr, on both the RX and TX rings.
+const (
+	virtioNetHdrFlagNeedsCsum = 1
+
+	virtioNetHdrGSONone  = 0
+	virtioNetHdrGSOTCPv4 = 1
+	virtioNetHdrGSOUDPL4 = 5
+	virtioNetHdrGSOTCPv6 = 4
+)
+
+// virtioNetHdr mirrors struct virtio_net_hdr. It is prefixed to each frame
+// when PACKET_VNET_HDR is negotiated.
+type virtioNetHdr struct {
+	Flags      uint8
+	GSOType    uint8
+	HdrLen     uint16
+	GSOSize    uint16
+	CsumStart  uint16
+	CsumOffset uint16
+}
+
+const virtioNetHdrLen = int(unsafe.Sizeof(virtioNetHdr{}))
+
+// OptVNetHdr, if set, requests PACKET_VNET_HDR on the underlying socket so
+// that every ring frame is prefixed with a virtio_net_hdr describing GSO/GRO
+// offload state, enabling ReadSegments and WriteSegments below.
+func (h *TPacket) setsockoptVNetHdr() error {
+	if !h.opts.vnetHdr {
+		return nil
+	}
+	return setsockoptInt(h.fd, unix.SOL_PACKET, unix.PACKET_VNET_HDR, 1)
+}
+
+func parseVirtioNetHdr(b []byte) (virtioNetHdr, error) {
+	var v virtioNetHdr
+	if len(b) < virtioNetHdrLen {
+		return v, fmt.Errorf("afpacket: short virtio_net_hdr, have %d bytes want %d", len(b), virtioNetHdrLen)
+	}
+	v.Flags = b[0]
+	v.GSOType = b[1]
+	v.HdrLen = binary.LittleEndian.Uint16(b[2:4])
+	v.GSOSize = binary.LittleEndian.Uint16(b[4:6])
+	v.CsumStart = binary.LittleEndian.Uint16(b[6:8])
+	v.CsumOffset = binary.LittleEndian.Uint16(b[8:10])
+	return v, nil
+}
+
+func (v virtioNetHdr) encode(b []byte) {
+	b[0] = v.Flags
+	b[1] = v.GSOType
+	binary.LittleEndian.PutUint16(b[2:4], v.HdrLen)
+	binary.LittleEndian.PutUint16(b[4:6], v.GSOSize)
+	binary.LittleEndian.PutUint16(b[6:8], v.CsumStart)
+	binary.LittleEndian.PutUint16(b[8:10], v.CsumOffset)
+}
+
+// ReadSegments reads one super-frame off the RX ring and, if it carries a
+// coalesced GSO payload (gso_type != virtioNetHdrGSONone), splits it into
+// MSS-sized segments written into bufs, reporting each segment's length in
+// sizes. It returns the number of segments produced. Frames with no GSO
+// annotation produce a single segment, identical to ReadPacketData.
+func (h *TPacket) ReadSegments(bufs [][]byte, sizes []int, offset int) (n int, err error) {
+	if !h.opts.vnetHdr {
+		return 0, fmt.Errorf("afpacket: ReadSegments requires OptVNetHdr")
+	}
+
+	data, _, _, _, _, _, err := h.readPacketDataRaw()
+	if err != nil {
+		return 0, err
+	}
+
+	vh, err := parseVirtioNetHdr(data)
+	if err != nil {
+		return 0, err
+	}
+	payload := data[virtioNetHdrLen:]
+
+	if vh.GSOType == virtioNetHdrGSONone || vh.GSOSize == 0 {
+		if len(bufs) < 1 {
+			return 0, fmt.Errorf("afpacket: need at least one buffer")
+		}
+		m := copy(bufs[0][offset:], payload)
+		sizes[0] = m
+		return 1, nil
+	}
+
+	// TCP GSO would additionally need the per-segment sequence number
+	// advanced by each prior segment's payload length, which this package
+	// doesn't yet implement; rather than hand back segments with a stale,
+	// duplicated seq number, refuse to split them.
+	if vh.GSOType != virtioNetHdrGSOUDPL4 {
+		return 0, fmt.Errorf("afpacket: ReadSegments only supports UDP GSO segments, got gso_type %d", vh.GSOType)
+	}
+
+	hdrLen := int(vh.HdrLen)
+	if hdrLen > len(payload) {
+		return 0, fmt.Errorf("afpacket: virtio_net_hdr hdr_len %d exceeds payload length %d", hdrLen, len(payload))
+	}
+	if len(sizes) < len(bufs) {
+		return 0, fmt.Errorf("afpacket: sizes has %d entries, need at least len(bufs)=%d", len(sizes), len(bufs))
+	}
+	mss := int(vh.GSOSize)
+	body := payload[hdrLen:]
+	baseIPID := ipv4Identification(payload[:hdrLen])
+
+	seg := 0
+	for len(body) > 0 && seg < len(bufs) {
+		n := mss
+		if n > len(body) {
+			n = len(body)
+		}
+		frame := bufs[seg][offset:]
+		m := copy(frame, payload[:hdrLen])
+		m += copy(frame[m:], body[:n])
+		rewriteUDPSegment(frame[:m], hdrLen, n, baseIPID+uint16(seg))
+		sizes[seg] = m
+		body = body[n:]
+		seg++
+	}
+	return seg, nil
+}
+
+// ipHeaderLen returns the length of the IP header (v4 or v6) at the start of
+// an Ethernet payload, so callers can locate the L4 header that follows it
+// without assuming a fixed, options-free IPv4 header.
+func ipHeaderLen(ipHdr []byte) (int, error) {
+	if len(ipHdr) < 15 {
+		return 0, fmt.Errorf("afpacket: header too short to contain an IP version nibble")
+	}
+	switch ipHdr[14] >> 4 {
+	case 4:
+		ihl := int(ipHdr[14]&0xf) * 4
+		if len(ipHdr) < 14+ihl {
+			return 0, fmt.Errorf("afpacket: IPv4 IHL %d exceeds header length %d", ihl, len(ipHdr)-14)
+		}
+		return ihl, nil
+	case 6:
+		if len(ipHdr) < 14+40 {
+			return 0, fmt.Errorf("afpacket: header too short for a 40-byte IPv6 header")
+		}
+		return 40, nil
+	default:
+		return 0, fmt.Errorf("afpacket: unrecognized IP version %d", ipHdr[14]>>4)
+	}
+}
+
+// ipv4Identification returns the IPv4 header's identification field, or 0
+// for a non-IPv4 (e.g. IPv6) header, which has no equivalent field.
+func ipv4Identification(ipHdr []byte) uint16 {
+	if len(ipHdr) < 14+6 || ipHdr[14]>>4 != 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(ipHdr[14+4 : 14+6])
+}
+
+// rewriteUDPSegment patches a split-out UDP GSO segment's IP total/payload
+// length, IP identification (IPv4 only, bumped per segment so segments
+// don't appear to be retransmits/duplicates of one another), UDP length,
+// and recomputes the IP header checksum (IPv4) and UDP checksum so each
+// segment is a valid, independently-routable packet in its own right.
+func rewriteUDPSegment(seg []byte, hdrLen, payloadLen int, ipID uint16) {
+	if len(seg) < hdrLen {
+		return
+	}
+
+	switch seg[0] >> 4 {
+	case 4: // IPv4
+		ihl := int(seg[0]&0xf) * 4
+		ipLen := hdrLen - 14 + payloadLen
+		binary.BigEndian.PutUint16(seg[14+2:14+4], uint16(ipLen))
+		binary.BigEndian.PutUint16(seg[14+4:14+6], ipID)
+		binary.BigEndian.PutUint16(seg[14+10:14+12], 0)
+		binary.BigEndian.PutUint16(seg[14+10:14+12], checksum(seg[14:14+ihl], 0))
+
+		udpOff := 14 + ihl
+		udpLen := 8 + payloadLen
+		binary.BigEndian.PutUint16(seg[udpOff+4:udpOff+6], uint16(udpLen))
+		binary.BigEndian.PutUint16(seg[udpOff+6:udpOff+8], 0)
+		pseudo := ipv4PseudoHeaderSum(seg[14:14+ihl], uint16(udpLen))
+		binary.BigEndian.PutUint16(seg[udpOff+6:udpOff+8], udpChecksumOrFFFF(seg[udpOff:udpOff+udpLen], pseudo))
+
+	case 6: // IPv6
+		payLen := hdrLen - 14 - 40 + payloadLen
+		binary.BigEndian.PutUint16(seg[14+4:14+6], uint16(payLen))
+
+		udpOff := 14 + 40
+		udpLen := 8 + payloadLen
+		binary.BigEndian.PutUint16(seg[udpOff+4:udpOff+6], uint16(udpLen))
+		binary.BigEndian.PutUint16(seg[udpOff+6:udpOff+8], 0)
+		pseudo := ipv6PseudoHeaderSum(seg[14:14+40], uint32(udpLen))
+		binary.BigEndian.PutUint16(seg[udpOff+6:udpOff+8], udpChecksumOrFFFF(seg[udpOff:udpOff+udpLen], pseudo))
+	}
+}
+
+// udpChecksumOrFFFF computes the UDP checksum and remaps a computed value of
+// 0 to 0xffff: unlike TCP, UDP reserves an on-the-wire checksum of 0 to mean
+// "no checksum", so a genuinely-zero computed checksum must be transmitted
+// as its one's-complement, 0xffff, or a receiver would treat the segment as
+// uncheck-summed instead of validating it.
+func udpChecksumOrFFFF(b []byte, initial uint32) uint16 {
+	if c := checksum(b, initial); c != 0 {
+		return c
+	}
+	return 0xffff
+}
+
+// checksum is the Internet checksum (RFC 1071) of b, folded on top of a
+// running sum (e.g. a pseudo-header sum already accumulated elsewhere).
+func checksum(b []byte, initial uint32) uint16 {
+	sum := initial
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// ipv4PseudoHeaderSum accumulates the IPv4 UDP pseudo-header (src/dst
+// addresses, zero, protocol, UDP length) into a checksum running sum.
+func ipv4PseudoHeaderSum(ipHdr []byte, udpLen uint16) uint32 {
+	var sum uint32
+	sum += uint32(binary.BigEndian.Uint16(ipHdr[12:14]))
+	sum += uint32(binary.BigEndian.Uint16(ipHdr[14:16]))
+	sum += uint32(binary.BigEndian.Uint16(ipHdr[16:18]))
+	sum += uint32(binary.BigEndian.Uint16(ipHdr[18:20]))
+	sum += uint32(unix.IPPROTO_UDP)
+	sum += uint32(udpLen)
+	return sum
+}
+
+// ipv6PseudoHeaderSum accumulates the IPv6 UDP pseudo-header (src/dst
+// addresses, UDP length, next header) into a checksum running sum.
+func ipv6PseudoHeaderSum(ipHdr []byte, udpLen uint32) uint32 {
+	var sum uint32
+	for i := 8; i < 40; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(ipHdr[i : i+2]))
+	}
+	sum += udpLen >> 16
+	sum += udpLen & 0xffff
+	sum += uint32(unix.IPPROTO_UDP)
+	return sum
+}
+
+// WriteSegments stitches a batch of same-flow packets into a single GSO
+// super-frame (one shared L2/L3/L4 header followed by concatenated
+// payloads), fills in a virtio_net_hdr describing the offload, and hands it
+// to the kernel via WritePacketData. segmentSize is the MSS used to derive
+// GSOSize; all packets in bufs must share the same headers up to
+// segmentSize's payload boundary.
+func (h *TPacket) WriteSegments(bufs [][]byte, segmentSize int) error {
+	if !h.opts.vnetHdr {
+		return fmt.Errorf("afpacket: WriteSegments requires OptVNetHdr")
+	}
+	if len(bufs) == 0 {
+		return fmt.Errorf("afpacket: no segments to write")
+	}
+
+	hdrLen := len(bufs[0]) - segmentSize
+	if hdrLen < 0 {
+		return fmt.Errorf("afpacket: segmentSize %d larger than first segment", segmentSize)
+	}
+	ipHdrLen, err := ipHeaderLen(bufs[0][:hdrLen])
+	if err != nil {
+		return err
+	}
+
+	total := virtioNetHdrLen + len(bufs[0])
+	for _, b := range bufs[1:] {
+		total += len(b) - hdrLen
+	}
+
+	frame := make([]byte, total)
+	vh := virtioNetHdr{
+		Flags:   virtioNetHdrFlagNeedsCsum,
+		GSOType: virtioNetHdrGSOUDPL4,
+		HdrLen:  uint16(hdrLen),
+		GSOSize: uint16(segmentSize),
+		// CsumStart is the UDP header's offset, which varies with the L3
+		// header's actual length (IPv4 options, or IPv6's fixed-but-larger
+		// header), not a fixed Ethernet+IPv4-without-options offset.
+		CsumStart:  uint16(14 + ipHdrLen),
+		CsumOffset: 6,
+	}
+	vh.encode(frame)
+
+	off := virtioNetHdrLen
+	off += copy(frame[off:], bufs[0])
+	for _, b := range bufs[1:] {
+		off += copy(frame[off:], b[hdrLen:])
+	}
+
+	return h.WritePacketData(frame[:off])
+}
@@ -34,6 +34,12 @@ type header interface {
 	// getTime returns the timestamp for the current packet pointed to by
 	// the header.
 	getTime() time.Time
+	// getHardwareTime returns the NIC-provided hardware timestamp for the
+	// current packet, if the socket was configured with
+	// OptHardwareTimestamps and the kernel populated one for this packet.
+	// The bool is false when no hardware timestamp is available, in which
+	// case callers should fall back to getTime().
+	getHardwareTime() (time.Time, bool)
 	// getData returns the packet data pointed to by the current header.
 	getData(opts *options) []byte
 	// getLength returns the total length of the packet.
@@ -52,6 +58,13 @@ type header interface {
 
 const tpacketAlignment = uint(unix.TPACKET_ALIGNMENT)
 
+// tpStatusTSRawHardware is TP_STATUS_TS_RAW_HARDWARE, the tp_status bit the
+// kernel sets on a frame whose tp_sec/tp_nsec carry a hardware (rather than
+// software) timestamp, per SO_TIMESTAMPING with SOF_TIMESTAMPING_RAW_HARDWARE.
+// It is not exposed by golang.org/x/sys/unix, so its documented kernel value
+// is reproduced here.
+const tpStatusTSRawHardware uint32 = 1 << 31
+
 func tpAlign(x int) int {
 	return int((uint(x) + tpacketAlignment - 1) &^ (tpacketAlignment - 1))
 }
@@ -86,6 +99,11 @@ func (h *TpV1Hdr) clearStatus() {
 func (h *TpV1Hdr) getTime() time.Time {
 	return time.Unix(int64(h.Sec), int64(h.Usec)*1000)
 }
+func (h *TpV1Hdr) getHardwareTime() (time.Time, bool) {
+	// TPACKET_V1 predates SO_TIMESTAMPING support; it never carries a
+	// hardware timestamp.
+	return time.Time{}, false
+}
 func (h *TpV1Hdr) getData(opts *options) []byte {
 	return makeSlice(uintptr(unsafe.Pointer(h))+uintptr(h.Mac), int(h.Snaplen))
 }
@@ -112,6 +130,18 @@ func (h *TpV2Hdr) clearStatus() {
 func (h *TpV2Hdr) getTime() time.Time {
 	return time.Unix(int64(h.Sec), int64(h.Nsec))
 }
+
+// getHardwareTime returns a NIC-provided hardware timestamp when the socket
+// was set up with SO_TIMESTAMPING (SOF_TIMESTAMPING_RAW_HARDWARE |
+// SOF_TIMESTAMPING_RX_HARDWARE): in that mode the kernel repurposes
+// tp_sec/tp_nsec to carry the hardware clock reading instead of the
+// software receive time, and marks the header with tpStatusTSRawHardware.
+func (h *TpV2Hdr) getHardwareTime() (time.Time, bool) {
+	if h.Status&tpStatusTSRawHardware == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(h.Sec), int64(h.Nsec)), true
+}
 func (h *TpV2Hdr) getData(opts *options) []byte {
 	data := makeSlice(uintptr(unsafe.Pointer(h))+uintptr(h.Mac), int(h.Snaplen))
 	return insertVlanHeader(data, int(h.Vlan_tci), opts)
@@ -151,6 +181,16 @@ func (w *TpV3Hdr) clearStatus() {
 func (w *TpV3Hdr) getTime() time.Time {
 	return time.Unix(int64(w.packet.Sec), int64(w.packet.Nsec))
 }
+
+// getHardwareTime mirrors TpV2Hdr.getHardwareTime: with SO_TIMESTAMPING's
+// raw-hardware flags configured, tpacket3_hdr's Sec/Nsec carry the NIC clock
+// reading for this packet rather than software receive time.
+func (w *TpV3Hdr) getHardwareTime() (time.Time, bool) {
+	if w.packet.Status&tpStatusTSRawHardware == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(w.packet.Sec), int64(w.packet.Nsec)), true
+}
 func (w *TpV3Hdr) getData(opts *options) []byte {
 	data := makeSlice(uintptr(unsafe.Pointer(w.packet))+uintptr(w.packet.Mac), int(w.packet.Snaplen))
 
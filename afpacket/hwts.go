@@ -0,0 +1,140 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+//go:build linux
+// +build linux
+
+package afpacket
+
+import (
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// SOF_TIMESTAMPING_* flags relevant to requesting NIC hardware timestamps.
+// Only the subset OptHardwareTimestamps needs is reproduced here; the full
+// set lives in linux/net_tstamp.h.
+const (
+	sofTimestampingRawHardware = 1 << 6
+	sofTimestampingRxHardware  = 1 << 2
+)
+
+// hwtstampConfig mirrors struct hwtstamp_config, passed to SIOCSHWTSTAMP to
+// ask the NIC driver itself to timestamp (and not just the kernel stack).
+type hwtstampConfig struct {
+	Flags    int32
+	TxType   int32
+	RxFilter int32
+}
+
+const (
+	hwtstampTxOff       = 0
+	hwtstampRxFilterAll = 1
+)
+
+// ifreqSize is sizeof(struct ifreq) on amd64: a 16-byte ifr_name followed by
+// a 24-byte ifr_ifru union. SIOCSHWTSTAMP's ioctl handler copies the whole
+// struct out of user memory regardless of which union member the caller
+// actually populated, so ifreqHwtstamp below needs to be padded out to this
+// size or the copy reads past the end of it.
+const ifreqSize = 40
+
+// ifreqHwtstamp mirrors the portion of struct ifreq used by SIOCSHWTSTAMP:
+// an interface name followed by a pointer to a hwtstamp_config in the
+// ifr_data union member, padded to ifreqSize.
+type ifreqHwtstamp struct {
+	Name [unix.IFNAMSIZ]byte
+	Data unsafe.Pointer
+	_    [ifreqSize - unix.IFNAMSIZ - 8]byte
+}
+
+// setsockoptHardwareTimestamps configures the socket for NIC hardware
+// timestamps: it issues SIOCSHWTSTAMP on iface to turn on hardware
+// timestamping at the driver, then setsockopt(SO_TIMESTAMPING) on the
+// socket itself so the kernel reports those timestamps (via the tp_sec/
+// tp_nsec reuse that TpV2Hdr/TpV3Hdr.getHardwareTime decode) instead of,
+// or alongside, software receive time.
+func (h *TPacket) setsockoptHardwareTimestamps() error {
+	if !h.opts.hwTimestamps {
+		return nil
+	}
+
+	var req ifreqHwtstamp
+	copy(req.Name[:], h.opts.iface)
+	cfg := hwtstampConfig{
+		Flags:    0,
+		TxType:   hwtstampTxOff,
+		RxFilter: hwtstampRxFilterAll,
+	}
+	req.Data = unsafe.Pointer(&cfg)
+	if err := ioctl(h.fd, unix.SIOCSHWTSTAMP, unsafe.Pointer(&req)); err != nil {
+		return err
+	}
+
+	flags := int32(sofTimestampingRawHardware | sofTimestampingRxHardware)
+	return setsockopt(h.fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPING, unsafe.Pointer(&flags), unsafe.Sizeof(flags))
+}
+
+func ioctl(fd int, req uint, arg unsafe.Pointer) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// CaptureInfo mirrors gopacket's ci.CaptureInfo field-for-field. It's defined
+// here, rather than embedding the real type, because this tree doesn't
+// vendor the gopacket core package; once merged upstream,
+// ZeroCopyReadPacketData should return ci.CaptureInfo instead.
+type CaptureInfo struct {
+	// Timestamp is the time the packet was received.
+	Timestamp time.Time
+	// CaptureLength is the number of bytes actually available in Data.
+	CaptureLength int
+	// Length is the packet's length on the wire, which may exceed
+	// CaptureLength if the capture snaplen truncated it.
+	Length int
+	// InterfaceIndex is the index of the interface the packet was seen on.
+	InterfaceIndex int
+	// AncillaryData holds out-of-band data the kernel attached to the
+	// packet, e.g. an AncillaryHWTimestamp below.
+	AncillaryData []interface{}
+}
+
+// AncillaryHWTimestamp is a CaptureInfo.AncillaryData entry carrying the
+// NIC-provided hardware timestamp for a packet, appended by
+// ZeroCopyReadPacketData whenever getHardwareTime reports one available,
+// alongside the existing CaptureInfo.Timestamp.
+type AncillaryHWTimestamp struct {
+	Timestamp time.Time
+}
+
+// ZeroCopyReadPacketData reads the next packet off the RX ring. Its
+// signature matches gopacket's ZeroCopyPacketDataSource interface
+// (data []byte, ci gopacket.CaptureInfo, err error): see CaptureInfo above
+// for why this tree uses a local stand-in rather than gopacket.CaptureInfo
+// itself. When the socket was set up with OptHardwareTimestamps and the
+// frame carried a NIC hardware timestamp, ci.AncillaryData contains an
+// AncillaryHWTimestamp.
+func (h *TPacket) ZeroCopyReadPacketData() (data []byte, ci CaptureInfo, err error) {
+	data, ts, length, ifaceIndex, hwTime, hwOK, err := h.readPacketDataRaw()
+	if err != nil {
+		return nil, CaptureInfo{}, err
+	}
+	ci = CaptureInfo{
+		Timestamp:      ts,
+		CaptureLength:  len(data),
+		Length:         length,
+		InterfaceIndex: ifaceIndex,
+	}
+	if hwOK {
+		ci.AncillaryData = append(ci.AncillaryData, AncillaryHWTimestamp{Timestamp: hwTime})
+	}
+	return data, ci, nil
+}